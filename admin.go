@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// requireAdminToken wraps next with bearer-token auth. An empty token
+// disables auth entirely, which is only appropriate for local development.
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if got == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// serverStatus is the admin API's JSON view of one backend server.
+type serverStatus struct {
+	Pool     string `json:"pool"`
+	Address  string `json:"address"`
+	Weight   int    `json:"weight"`
+	Alive    bool   `json:"alive"`
+	Inflight int64  `json:"inflight"`
+}
+
+type addServerRequest struct {
+	Pool    string `json:"pool"`
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+}
+
+type patchServerRequest struct {
+	Weight *int  `json:"weight"`
+	Drain  *bool `json:"drain"`
+}
+
+// adminServersHandler serves the /admin/servers and /admin/servers/{addr}
+// endpoints: GET lists every backend across every pool, POST adds one to a
+// named pool, PATCH updates an existing backend's weight or drain state,
+// and DELETE removes one.
+func adminServersHandler(lb *LoadBalancer) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/admin/servers":
+			listServers(lb, rw)
+		case r.Method == http.MethodPost && r.URL.Path == "/admin/servers":
+			addServer(lb, rw, r)
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/admin/servers/"):
+			removeServer(lb, rw, r)
+		case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/admin/servers/"):
+			patchServer(lb, rw, r)
+		default:
+			http.NotFound(rw, r)
+		}
+	})
+}
+
+func listServers(lb *LoadBalancer, rw http.ResponseWriter) {
+	statuses := []serverStatus{}
+	for _, pool := range lb.getRouter().pools() {
+		for _, s := range pool.Servers() {
+			statuses = append(statuses, serverStatus{
+				Pool:     pool.Name,
+				Address:  s.Address(),
+				Weight:   serverWeight(s),
+				Alive:    s.IsAlive(),
+				Inflight: serverInflight(s),
+			})
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(statuses)
+}
+
+func addServer(lb *LoadBalancer, rw http.ResponseWriter, r *http.Request) {
+	var req addServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pool := findPool(lb, req.Pool)
+	if pool == nil {
+		http.Error(rw, "unknown pool", http.StatusNotFound)
+		return
+	}
+
+	weight := req.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	pool.AddServer(newWeightedSimpleServer(req.Address, weight))
+	rw.WriteHeader(http.StatusCreated)
+}
+
+func removeServer(lb *LoadBalancer, rw http.ResponseWriter, r *http.Request) {
+	addr, err := serverAddrFromPath(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, pool := range lb.getRouter().pools() {
+		if pool.RemoveServer(addr) {
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.NotFound(rw, r)
+}
+
+func patchServer(lb *LoadBalancer, rw http.ResponseWriter, r *http.Request) {
+	addr, err := serverAddrFromPath(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req patchServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, pool := range lb.getRouter().pools() {
+		s := pool.FindServer(addr)
+		if s == nil {
+			continue
+		}
+
+		if req.Weight != nil {
+			if ws, ok := s.(WeightSetter); ok {
+				ws.SetWeight(*req.Weight)
+			}
+		}
+		if req.Drain != nil {
+			if d, ok := s.(Drainer); ok {
+				if *req.Drain {
+					d.Drain()
+				} else {
+					d.Undrain()
+				}
+			}
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+	http.NotFound(rw, r)
+}
+
+func findPool(lb *LoadBalancer, name string) *Pool {
+	for _, pool := range lb.getRouter().pools() {
+		if pool.Name == name {
+			return pool
+		}
+	}
+	return nil
+}
+
+func serverAddrFromPath(r *http.Request) (string, error) {
+	raw := strings.TrimPrefix(r.URL.Path, "/admin/servers/")
+	return url.PathUnescape(raw)
+}
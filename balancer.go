@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Balancer picks which of the given (already alive-filtered) servers should
+// handle req. Implementations must be safe for concurrent use, since
+// serveProxy is called from many goroutines at once.
+type Balancer interface {
+	Next(servers []Server, req *http.Request) Server
+}
+
+// Weighted is implemented by servers that carry a relative weight for the
+// weighted balancing strategies. Servers that don't implement it (or report
+// a weight <= 0) are treated as weight 1.
+type Weighted interface {
+	Weight() int
+}
+
+// ConnCounter is implemented by servers that track their own in-flight
+// request count, used by the least-connections and power-of-two-choices
+// strategies.
+type ConnCounter interface {
+	Inflight() int64
+}
+
+// WeightSetter is implemented by servers whose weight can be changed at
+// runtime, e.g. via the admin API's PATCH /admin/servers/{addr}.
+type WeightSetter interface {
+	SetWeight(w int)
+}
+
+// Drainer is implemented by servers that support being excluded from
+// rotation independently of their health state, e.g. via the admin API's
+// PATCH /admin/servers/{addr} drain flag.
+type Drainer interface {
+	Drain()
+	Undrain()
+}
+
+func serverWeight(s Server) int {
+	if w, ok := s.(Weighted); ok && w.Weight() > 0 {
+		return w.Weight()
+	}
+	return 1
+}
+
+func serverInflight(s Server) int64 {
+	if c, ok := s.(ConnCounter); ok {
+		return c.Inflight()
+	}
+	return 0
+}
+
+// roundRobinBalancer cycles through servers in order. It owns the counter
+// that used to live on LoadBalancer, guarded by a mutex so concurrent
+// serveProxy calls can't race on it.
+type roundRobinBalancer struct {
+	mu      sync.Mutex
+	counter int
+}
+
+// NewRoundRobinBalancer returns the default balancing strategy.
+func NewRoundRobinBalancer() *roundRobinBalancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Next(servers []Server, _ *http.Request) Server {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := servers[b.counter%len(servers)]
+	b.counter++
+	return s
+}
+
+// weightedRoundRobinBalancer implements smooth weighted round robin: each
+// pick goes to the server whose running weight is currently highest, after
+// which that server's running weight is reduced by the total weight. This
+// spreads picks evenly instead of bursting all requests to the heaviest
+// server first.
+type weightedRoundRobinBalancer struct {
+	mu    sync.Mutex
+	state map[string]int
+}
+
+// NewWeightedRoundRobinBalancer returns a balancer that favors servers with
+// a higher Weight().
+func NewWeightedRoundRobinBalancer() *weightedRoundRobinBalancer {
+	return &weightedRoundRobinBalancer{state: make(map[string]int)}
+}
+
+func (b *weightedRoundRobinBalancer) Next(servers []Server, _ *http.Request) Server {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := 0
+	var best Server
+	bestWeight := -1
+	for _, s := range servers {
+		w := serverWeight(s)
+		total += w
+
+		cur := b.state[s.Address()] + w
+		b.state[s.Address()] = cur
+		if cur > bestWeight {
+			bestWeight = cur
+			best = s
+		}
+	}
+
+	b.state[best.Address()] -= total
+	return best
+}
+
+// leastConnectionsBalancer sends each request to the server with the fewest
+// in-flight requests.
+type leastConnectionsBalancer struct{}
+
+// NewLeastConnectionsBalancer returns a balancer based on live connection
+// counts rather than a fixed rotation.
+func NewLeastConnectionsBalancer() *leastConnectionsBalancer {
+	return &leastConnectionsBalancer{}
+}
+
+func (b *leastConnectionsBalancer) Next(servers []Server, _ *http.Request) Server {
+	best := servers[0]
+	bestInflight := serverInflight(best)
+	for _, s := range servers[1:] {
+		if in := serverInflight(s); in < bestInflight {
+			best, bestInflight = s, in
+		}
+	}
+	return best
+}
+
+// powerOfTwoBalancer picks two servers at random and routes to whichever has
+// fewer in-flight requests. It approximates least-connections behaviour
+// without having to consider every server on every request.
+type powerOfTwoBalancer struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewPowerOfTwoBalancer returns a power-of-two-choices balancer.
+func NewPowerOfTwoBalancer() *powerOfTwoBalancer {
+	return &powerOfTwoBalancer{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *powerOfTwoBalancer) Next(servers []Server, _ *http.Request) Server {
+	if len(servers) == 1 {
+		return servers[0]
+	}
+
+	b.mu.Lock()
+	i := b.rnd.Intn(len(servers))
+	j := b.rnd.Intn(len(servers) - 1)
+	b.mu.Unlock()
+	if j >= i {
+		j++
+	}
+
+	a, c := servers[i], servers[j]
+	if serverInflight(a) <= serverInflight(c) {
+		return a
+	}
+	return c
+}
+
+// randomWeightedBalancer picks a server at random with probability
+// proportional to its weight.
+type randomWeightedBalancer struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewRandomWeightedBalancer returns a weighted-random balancer.
+func NewRandomWeightedBalancer() *randomWeightedBalancer {
+	return &randomWeightedBalancer{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *randomWeightedBalancer) Next(servers []Server, _ *http.Request) Server {
+	total := 0
+	for _, s := range servers {
+		total += serverWeight(s)
+	}
+
+	b.mu.Lock()
+	n := b.rnd.Intn(total)
+	b.mu.Unlock()
+
+	for _, s := range servers {
+		n -= serverWeight(s)
+		if n < 0 {
+			return s
+		}
+	}
+	return servers[len(servers)-1]
+}
+
+// consistentHashBalancer routes requests for the same key (client IP, or a
+// configurable header for sticky sessions) to the same server; when pool
+// membership changes, only the keys on the ring segments next to the added
+// or removed server's positions move. It builds the hash ring fresh on each call, which is
+// simple and fast enough for pool sizes this balancer is meant for.
+type consistentHashBalancer struct {
+	// Header is the request header to hash on; if it's absent from a
+	// request, or Header is empty, the client IP is used instead.
+	Header string
+
+	// virtualNodes is the number of ring positions per server; more nodes
+	// spread load more evenly at the cost of a bigger ring to search.
+	virtualNodes int
+}
+
+// NewConsistentHashBalancer returns a balancer that sticks a given key
+// (derived from header, or the client IP if header is "") to the same
+// server while the pool membership is unchanged; adding a server can move
+// some keys to it, and removing one moves only the keys it held.
+func NewConsistentHashBalancer(header string) *consistentHashBalancer {
+	return &consistentHashBalancer{Header: header, virtualNodes: 100}
+}
+
+func (b *consistentHashBalancer) Next(servers []Server, req *http.Request) Server {
+	type ringNode struct {
+		hash   uint32
+		server Server
+	}
+
+	nodes := make([]ringNode, 0, len(servers)*b.virtualNodes)
+	for _, s := range servers {
+		for i := 0; i < b.virtualNodes; i++ {
+			nodes = append(nodes, ringNode{hash: hashKey(s.Address(), i), server: s})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].hash < nodes[j].hash })
+
+	h := hashKey(b.key(req), -1)
+	idx := sort.Search(len(nodes), func(i int) bool { return nodes[i].hash >= h })
+	if idx == len(nodes) {
+		idx = 0
+	}
+	return nodes[idx].server
+}
+
+func (b *consistentHashBalancer) key(req *http.Request) string {
+	if b.Header != "" {
+		if v := req.Header.Get(b.Header); v != "" {
+			return v
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func hashKey(key string, virtualNode int) uint32 {
+	if virtualNode >= 0 {
+		key = fmt.Sprintf("%s#%d", key, virtualNode)
+	}
+	return crc32.ChecksumIEEE([]byte(key))
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration wraps time.Duration so config files can write "10s" instead of a
+// raw nanosecond count, in both JSON and YAML.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+
+	var n int64
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*d = Duration(n)
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err == nil {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+
+	var n int64
+	if err := node.Decode(&n); err != nil {
+		return err
+	}
+	*d = Duration(n)
+	return nil
+}
+
+// Config is the top-level shape of the load balancer's config file,
+// describing the listeners, backend pools, and routing rules that
+// BuildLoadBalancer turns into a running LoadBalancer.
+type Config struct {
+	Listen         string                `json:"listen" yaml:"listen"`
+	AdminListen    string                `json:"adminListen" yaml:"adminListen"`
+	AdminToken     string                `json:"adminToken" yaml:"adminToken"`
+	RequestTimeout Duration              `json:"requestTimeout" yaml:"requestTimeout"`
+	MaxRetries     int                   `json:"maxRetries" yaml:"maxRetries"`
+	TrustedProxies []string              `json:"trustedProxies" yaml:"trustedProxies"`
+	TLS            *TLSConfigFile        `json:"tls" yaml:"tls"`
+	DefaultPool    string                `json:"defaultPool" yaml:"defaultPool"`
+	Pools          map[string]PoolConfig `json:"pools" yaml:"pools"`
+	Routes         []RouteConfig         `json:"routes" yaml:"routes"`
+}
+
+// TLSConfigFile is the config-file shape of TLSConfig.
+type TLSConfigFile struct {
+	CertFile string `json:"certFile" yaml:"certFile"`
+	KeyFile  string `json:"keyFile" yaml:"keyFile"`
+
+	ACMEEnabled  bool     `json:"acmeEnabled" yaml:"acmeEnabled"`
+	ACMEHosts    []string `json:"acmeHosts" yaml:"acmeHosts"`
+	ACMECacheDir string   `json:"acmeCacheDir" yaml:"acmeCacheDir"`
+
+	RedirectHTTP bool `json:"redirectHttp" yaml:"redirectHttp"`
+}
+
+func (f TLSConfigFile) toTLSConfig() TLSConfig {
+	return TLSConfig{
+		CertFile:     f.CertFile,
+		KeyFile:      f.KeyFile,
+		ACMEEnabled:  f.ACMEEnabled,
+		ACMEHosts:    f.ACMEHosts,
+		ACMECacheDir: f.ACMECacheDir,
+		RedirectHTTP: f.RedirectHTTP,
+	}
+}
+
+// PoolConfig describes one named backend pool.
+type PoolConfig struct {
+	Balancer    string                 `json:"balancer" yaml:"balancer"`
+	Backends    []BackendConfig        `json:"backends" yaml:"backends"`
+	HealthCheck *HealthCheckConfigFile `json:"healthCheck" yaml:"healthCheck"`
+}
+
+// BackendConfig describes one backend server within a pool.
+type BackendConfig struct {
+	Address string `json:"address" yaml:"address"`
+	Weight  int    `json:"weight" yaml:"weight"`
+}
+
+// RouteConfig describes one dispatch rule in front of the pools; see Route.
+type RouteConfig struct {
+	Host       string            `json:"host" yaml:"host"`
+	PathPrefix string            `json:"pathPrefix" yaml:"pathPrefix"`
+	PathRegex  string            `json:"pathRegex" yaml:"pathRegex"`
+	Method     string            `json:"method" yaml:"method"`
+	Headers    map[string]string `json:"headers" yaml:"headers"`
+	Pool       string            `json:"pool" yaml:"pool"`
+}
+
+// HealthCheckConfigFile is the config-file shape of HealthCheckConfig; it
+// exists separately so HealthCheckConfig itself doesn't need to carry
+// (de)serialization tags or the Duration wrapper type.
+type HealthCheckConfigFile struct {
+	Interval            Duration `json:"interval" yaml:"interval"`
+	Timeout             Duration `json:"timeout" yaml:"timeout"`
+	HealthyThreshold    int      `json:"healthyThreshold" yaml:"healthyThreshold"`
+	UnhealthyThreshold  int      `json:"unhealthyThreshold" yaml:"unhealthyThreshold"`
+	Path                string   `json:"path" yaml:"path"`
+	ExpectedStatuses    []int    `json:"expectedStatuses" yaml:"expectedStatuses"`
+	OutlierEnabled      bool     `json:"outlierEnabled" yaml:"outlierEnabled"`
+	OutlierErrorRate    float64  `json:"outlierErrorRate" yaml:"outlierErrorRate"`
+	OutlierMinRequests  int      `json:"outlierMinRequests" yaml:"outlierMinRequests"`
+	OutlierInterval     Duration `json:"outlierInterval" yaml:"outlierInterval"`
+	OutlierEjectionTime Duration `json:"outlierEjectionTime" yaml:"outlierEjectionTime"`
+}
+
+func (f HealthCheckConfigFile) toHealthCheckConfig() HealthCheckConfig {
+	return HealthCheckConfig{
+		Interval:            time.Duration(f.Interval),
+		Timeout:             time.Duration(f.Timeout),
+		HealthyThreshold:    f.HealthyThreshold,
+		UnhealthyThreshold:  f.UnhealthyThreshold,
+		Path:                f.Path,
+		ExpectedStatuses:    f.ExpectedStatuses,
+		OutlierEnabled:      f.OutlierEnabled,
+		OutlierErrorRate:    f.OutlierErrorRate,
+		OutlierMinRequests:  f.OutlierMinRequests,
+		OutlierInterval:     time.Duration(f.OutlierInterval),
+		OutlierEjectionTime: time.Duration(f.OutlierEjectionTime),
+	}
+}
+
+// LoadConfig reads and parses the config file at path, choosing JSON or
+// YAML based on its extension (.yaml/.yml vs anything else).
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config %s: %w", path, err)
+	}
+
+	cfg := &Config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing yaml config %s: %w", path, err)
+		}
+	default:
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing json config %s: %w", path, err)
+		}
+	}
+	return cfg, nil
+}
+
+// balancerFromName maps a config file's balancer name to a Balancer. Unknown
+// or empty names fall back to round robin.
+func balancerFromName(name string) Balancer {
+	switch name {
+	case "weighted-round-robin":
+		return NewWeightedRoundRobinBalancer()
+	case "least-connections":
+		return NewLeastConnectionsBalancer()
+	case "power-of-two":
+		return NewPowerOfTwoBalancer()
+	case "random-weighted":
+		return NewRandomWeightedBalancer()
+	case "consistent-hash":
+		return NewConsistentHashBalancer("")
+	case "consistent-hash-header":
+		return NewConsistentHashBalancer("X-Session-Id")
+	default:
+		return NewRoundRobinBalancer()
+	}
+}
+
+// BuildLoadBalancer constructs a LoadBalancer, its pools, and its routes
+// from cfg, and starts health checking on every pool whose config has a
+// healthCheck section; pools without one are not health checked.
+func BuildLoadBalancer(cfg *Config) (*LoadBalancer, error) {
+	pools := make(map[string]*Pool, len(cfg.Pools))
+	for name, pc := range cfg.Pools {
+		servers := make([]Server, 0, len(pc.Backends))
+		for _, b := range pc.Backends {
+			weight := b.Weight
+			if weight <= 0 {
+				weight = 1
+			}
+			servers = append(servers, newWeightedSimpleServer(b.Address, weight))
+		}
+		pools[name] = NewPool(name, servers, balancerFromName(pc.Balancer))
+	}
+
+	defaultPool, ok := pools[cfg.DefaultPool]
+	if !ok {
+		return nil, fmt.Errorf("default pool %q not found in config", cfg.DefaultPool)
+	}
+
+	router := &Router{Default: defaultPool}
+	for _, rc := range cfg.Routes {
+		pool, ok := pools[rc.Pool]
+		if !ok {
+			return nil, fmt.Errorf("route references unknown pool %q", rc.Pool)
+		}
+
+		route := &Route{
+			Host:       rc.Host,
+			PathPrefix: rc.PathPrefix,
+			Method:     rc.Method,
+			Headers:    rc.Headers,
+			Pool:       pool,
+		}
+		if rc.PathRegex != "" {
+			re, err := regexp.Compile(rc.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("route path regex %q: %w", rc.PathRegex, err)
+			}
+			route.PathRegex = re
+		}
+		router.Routes = append(router.Routes, route)
+	}
+
+	lb := NewLoadBalancerWithRouter(cfg.Listen, router)
+	if cfg.RequestTimeout > 0 {
+		lb.RequestTimeout = time.Duration(cfg.RequestTimeout)
+	}
+	if cfg.MaxRetries > 0 {
+		lb.MaxRetries = cfg.MaxRetries
+	}
+	lb.TrustedProxies = cfg.TrustedProxies
+
+	for name, pc := range cfg.Pools {
+		if pc.HealthCheck != nil {
+			pools[name].StartHealthChecks(pc.HealthCheck.toHealthCheckConfig())
+		}
+	}
+
+	return lb, nil
+}
+
+// ApplyConfig rebuilds a router and pool set from cfg and swaps it into lb
+// atomically, so requests already in flight keep running against the
+// router snapshot they started with while new requests see the reload. The
+// previous generation's pools are stopped once the swap is done, so their
+// health-checker goroutines don't leak across reloads.
+func (lb *LoadBalancer) ApplyConfig(cfg *Config) error {
+	next, err := BuildLoadBalancer(cfg)
+	if err != nil {
+		return err
+	}
+
+	if lb.metrics != nil {
+		next.SetMetrics(lb.metrics)
+	}
+
+	old := lb.getRouter()
+
+	lb.router.Store(next.getRouter())
+	lb.RequestTimeout = next.RequestTimeout
+	lb.MaxRetries = next.MaxRetries
+	lb.TrustedProxies = next.TrustedProxies
+
+	if old != nil {
+		keep := make(map[*Pool]bool)
+		for _, p := range next.getRouter().pools() {
+			keep[p] = true
+		}
+		for _, p := range old.pools() {
+			if !keep[p] {
+				p.Stop()
+			}
+		}
+	}
+
+	return nil
+}
+
+// WatchConfig polls path on the given interval and calls onReload with a
+// freshly loaded Config whenever the file's modification time advances. It
+// blocks until ctx is cancelled, so callers typically run it in a goroutine.
+func WatchConfig(ctx context.Context, path string, interval time.Duration, onReload func(*Config)) {
+	var lastMod time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil || !info.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				slog.Error("reloading config", "path", path, "error", err)
+				continue
+			}
+			onReload(cfg)
+		}
+	}
+}
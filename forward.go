@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// applyForwardedHeaders sets X-Forwarded-For, X-Forwarded-Proto, and
+// X-Forwarded-Host on req before it goes upstream. An inbound
+// X-Forwarded-For is only trusted (and appended to) when the direct peer is
+// in lb.TrustedProxies; otherwise it's discarded and replaced with just the
+// direct peer's address, so a client can't spoof the chain.
+func (lb *LoadBalancer) applyForwardedHeaders(req *http.Request) {
+	clientIP := clientIPFromRemoteAddr(req.RemoteAddr)
+
+	if existing := req.Header.Get("X-Forwarded-For"); existing != "" && lb.isTrustedProxy(clientIP) {
+		req.Header.Set("X-Forwarded-For", existing+", "+clientIP)
+	} else {
+		req.Header.Set("X-Forwarded-For", clientIP)
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", req.Host)
+}
+
+func clientIPFromRemoteAddr(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// isTrustedProxy reports whether ip (a direct TCP peer, not a header value)
+// appears in lb.TrustedProxies, which may contain individual IPs or CIDRs.
+func (lb *LoadBalancer) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, entry := range lb.TrustedProxies {
+		if entry == ip {
+			return true
+		}
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil && ipnet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUpgradeRequest reports whether req is asking to switch protocols (e.g.
+// a WebSocket handshake). httputil.ReverseProxy proxies these by hijacking
+// the ResponseWriter's underlying connection, which our retryRecorder can't
+// do, so serveProxy routes upgrade requests straight through without
+// buffering or retrying.
+func isUpgradeRequest(req *http.Request) bool {
+	return strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade")
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheckConfig configures how a HealthChecker probes servers and how it
+// reacts to live traffic errors (outlier detection).
+type HealthCheckConfig struct {
+	// Interval is how often each server is actively probed.
+	Interval time.Duration
+
+	// Timeout bounds a single probe.
+	Timeout time.Duration
+
+	// HealthyThreshold is the number of consecutive successful probes
+	// required before a down server is marked up again.
+	HealthyThreshold int
+
+	// UnhealthyThreshold is the number of consecutive failed probes
+	// required before an up server is marked down.
+	UnhealthyThreshold int
+
+	// Path is the HTTP path to probe. If empty, the checker falls back to
+	// a plain TCP dial against the server's address.
+	Path string
+
+	// ExpectedStatuses are the HTTP statuses considered healthy. Ignored
+	// in TCP-only mode. Defaults to [200] when empty.
+	ExpectedStatuses []int
+
+	// OutlierEnabled turns on passive ejection based on live traffic
+	// errors reported via HealthChecker.RecordResult.
+	OutlierEnabled bool
+
+	// OutlierErrorRate is the fraction of failed requests (0-1) within
+	// OutlierInterval that triggers an ejection.
+	OutlierErrorRate float64
+
+	// OutlierMinRequests is the minimum number of requests observed in
+	// OutlierInterval before the error rate is evaluated.
+	OutlierMinRequests int
+
+	// OutlierInterval is the rolling window over which the error rate is
+	// computed.
+	OutlierInterval time.Duration
+
+	// OutlierEjectionTime is how long an ejected server is kept out of
+	// rotation before it is re-admitted.
+	OutlierEjectionTime time.Duration
+}
+
+// DefaultHealthCheckConfig returns reasonable defaults for active checking
+// with outlier detection disabled.
+func DefaultHealthCheckConfig() HealthCheckConfig {
+	return HealthCheckConfig{
+		Interval:           10 * time.Second,
+		Timeout:            2 * time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+		ExpectedStatuses:   []int{http.StatusOK},
+	}
+}
+
+// liveness holds the up/down state for a single server. It is safe for
+// concurrent use and is meant to be embedded (or held by pointer) in Server
+// implementations.
+//
+// alive and drained are deliberately separate bits: alive is owned by the
+// active/passive health checker (MarkDown/MarkUp, flipped on probe results
+// and outlier ejection), while drained is owned by an operator via the
+// admin API (Drain/Undrain). Mixing the two would let a healthy backend's
+// next passing probe silently undo an operator's drain request.
+type liveness struct {
+	alive   int32 // 1 = alive, 0 = down; accessed atomically
+	drained int32 // 1 = drained by an operator, 0 = not; accessed atomically
+
+	mu              sync.Mutex
+	consecutiveOK   int
+	consecutiveFail int
+
+	outlierWindowStart time.Time
+	outlierRequests    int
+	outlierErrors      int
+	ejectedUntil       time.Time
+}
+
+func newLiveness() *liveness {
+	return &liveness{alive: 1}
+}
+
+// IsAlive reports whether the server should be considered for traffic: it
+// must be both healthy (see MarkUp/MarkDown) and not drained.
+func (l *liveness) IsAlive() bool {
+	return atomic.LoadInt32(&l.alive) == 1 && atomic.LoadInt32(&l.drained) == 0
+}
+
+func (l *liveness) MarkDown() { atomic.StoreInt32(&l.alive, 0) }
+
+func (l *liveness) MarkUp() { atomic.StoreInt32(&l.alive, 1) }
+
+// Drain excludes the server from rotation until Undrain is called,
+// regardless of what the health checker reports.
+func (l *liveness) Drain() { atomic.StoreInt32(&l.drained, 1) }
+
+// Undrain reverses Drain, letting health state alone decide the server's
+// availability again.
+func (l *liveness) Undrain() { atomic.StoreInt32(&l.drained, 0) }
+
+// HealthChecker actively probes a set of servers in the background and
+// passively ejects servers that misbehave on live traffic.
+type HealthChecker struct {
+	cfg     HealthCheckConfig
+	servers []Server
+	client  *http.Client
+	metrics atomic.Pointer[Metrics] // set via SetMetrics, may change while running
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewHealthChecker builds a HealthChecker for servers, applying defaults for
+// any zero-valued fields in cfg.
+func NewHealthChecker(cfg HealthCheckConfig, servers []Server) *HealthChecker {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.HealthyThreshold <= 0 {
+		cfg.HealthyThreshold = 2
+	}
+	if cfg.UnhealthyThreshold <= 0 {
+		cfg.UnhealthyThreshold = 3
+	}
+	if len(cfg.ExpectedStatuses) == 0 {
+		cfg.ExpectedStatuses = []int{http.StatusOK}
+	}
+	if cfg.OutlierInterval <= 0 {
+		cfg.OutlierInterval = 30 * time.Second
+	}
+	if cfg.OutlierEjectionTime <= 0 {
+		cfg.OutlierEjectionTime = 30 * time.Second
+	}
+
+	return &HealthChecker{
+		cfg:     cfg,
+		servers: servers,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// SetMetrics attaches m so health-state gauges are kept in sync with every
+// up/down transition this checker makes. Passing nil disables reporting.
+// Safe to call while the checker is running (e.g. from Pool.SetMetrics
+// after health checks have already started).
+func (hc *HealthChecker) SetMetrics(m *Metrics) {
+	hc.metrics.Store(m)
+}
+
+// Start launches one background goroutine per server that probes it on
+// cfg.Interval until Stop is called.
+func (hc *HealthChecker) Start() {
+	for _, s := range hc.servers {
+		hc.metrics.Load().setBackendUp(s.Address(), s.IsAlive())
+
+		hc.wg.Add(1)
+		go hc.run(s)
+	}
+}
+
+// Stop halts all probing goroutines and blocks until they've exited.
+func (hc *HealthChecker) Stop() {
+	close(hc.stopCh)
+	hc.wg.Wait()
+}
+
+func (hc *HealthChecker) run(s Server) {
+	defer hc.wg.Done()
+
+	ticker := time.NewTicker(hc.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hc.stopCh:
+			return
+		case <-ticker.C:
+			hc.evaluate(s, hc.probe(s))
+		}
+	}
+}
+
+// probe performs a single health check against s: an HTTP GET against
+// cfg.Path when set, or a TCP dial against s.Address() otherwise.
+func (hc *HealthChecker) probe(s Server) bool {
+	if hc.cfg.Path == "" {
+		host := s.Address()
+		if u, err := url.Parse(s.Address()); err == nil && u.Host != "" {
+			host = u.Host
+			if u.Port() == "" {
+				port := "80"
+				if u.Scheme == "https" {
+					port = "443"
+				}
+				host = net.JoinHostPort(u.Hostname(), port)
+			}
+		}
+		conn, err := net.DialTimeout("tcp", host, hc.cfg.Timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	resp, err := hc.client.Get(s.Address() + hc.cfg.Path)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	for _, want := range hc.cfg.ExpectedStatuses {
+		if resp.StatusCode == want {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate folds a single probe result into the server's consecutive
+// success/failure counters and flips its liveness once a threshold is
+// crossed.
+func (hc *HealthChecker) evaluate(s Server, ok bool) {
+	l, isLiveness := s.(interface{ livenessState() *liveness })
+	if !isLiveness {
+		return
+	}
+	state := l.livenessState()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if ok {
+		state.consecutiveOK++
+		state.consecutiveFail = 0
+		if !s.IsAlive() && state.consecutiveOK >= hc.cfg.HealthyThreshold && time.Now().After(state.ejectedUntil) {
+			s.MarkUp()
+			hc.metrics.Load().setBackendUp(s.Address(), true)
+		}
+	} else {
+		state.consecutiveFail++
+		state.consecutiveOK = 0
+		if s.IsAlive() && state.consecutiveFail >= hc.cfg.UnhealthyThreshold {
+			s.MarkDown()
+			hc.metrics.Load().setBackendUp(s.Address(), false)
+		}
+	}
+}
+
+// RecordResult feeds a live traffic outcome for s into outlier detection.
+// failed should be true when the request to s failed or returned a server error.
+// Once the rolling error rate crosses cfg.OutlierErrorRate, s is ejected for
+// cfg.OutlierEjectionTime.
+func (hc *HealthChecker) RecordResult(s Server, failed bool) {
+	if !hc.cfg.OutlierEnabled {
+		return
+	}
+
+	l, isLiveness := s.(interface{ livenessState() *liveness })
+	if !isLiveness {
+		return
+	}
+	state := l.livenessState()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(state.outlierWindowStart) > hc.cfg.OutlierInterval {
+		state.outlierWindowStart = now
+		state.outlierRequests = 0
+		state.outlierErrors = 0
+	}
+
+	state.outlierRequests++
+	if failed {
+		state.outlierErrors++
+	}
+
+	if !now.After(state.ejectedUntil) {
+		return
+	}
+
+	if state.outlierRequests >= hc.cfg.OutlierMinRequests &&
+		float64(state.outlierErrors)/float64(state.outlierRequests) >= hc.cfg.OutlierErrorRate {
+		state.ejectedUntil = now.Add(hc.cfg.OutlierEjectionTime)
+		s.MarkDown()
+		hc.metrics.Load().setBackendUp(s.Address(), false)
+	}
+}
@@ -1,32 +1,67 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // This is the LoadBalancer struct
-// It has a port, a roundRobinCounter, and a list of servers
-// The roundRobinCounter is used to keep track of which server to use next
-// The servers is a list of servers that the load balancer will connect to
+// It has a port and a router
+// The router resolves each request to a Pool of backend servers and picks
+// one within it, so a single LoadBalancer can front several backend pools
+// dispatched by host, path, method, or headers
+// The router is held behind an atomic pointer so a config reload
+// (ApplyConfig) can swap in a new one without requests in flight ever
+// seeing a partially-updated router
 // The port is the port that the load balancer will listen on
+// RequestTimeout bounds how long a single request, including retries, may
+// run before its context is cancelled; zero means no timeout
+// MaxRetries is how many additional servers are tried after the first one
+// fails before giving up
+// TrustedProxies lists the IPs/CIDRs of proxies allowed upstream of this
+// load balancer; only their X-Forwarded-For is trusted and appended to,
+// see applyForwardedHeaders
+// metrics, if set via SetMetrics, receives Prometheus observations for
+// every proxied request and health-state transition
 type LoadBalancer struct {
-	port 				string
-	roundRobinCounter 	int
-	servers				[]Server
+	port   string
+	router atomic.Pointer[Router]
+
+	RequestTimeout time.Duration
+	MaxRetries     int
+	TrustedProxies []string
+
+	metrics *Metrics
 }
 
 // This is the Server Interface.
-type Server interface{
+type Server interface {
 	// Address return the address with which to accesss the server
 	Address() string
 
 	// IsAlive returns true if the server is alive and false otherwise
 	IsAlive() bool
 
+	// MarkDown marks the server as unavailable so it is skipped by the
+	// balancer until MarkUp is called.
+	MarkDown()
+
+	// MarkUp marks the server as available again.
+	MarkUp()
+
 	// Serve uses this to process requests
 	Serve(rw http.ResponseWriter, r *http.Request)
 }
@@ -34,26 +69,87 @@ type Server interface{
 // This is the simpleServer struct
 // Address is the address of the server
 // Proxy is the proxy that the server uses to connect to the server
+// liveness tracks whether the server is currently up, maintained by a
+// HealthChecker
+// weight is this server's relative share for weighted balancing strategies
+// inflight is the number of requests currently being served, for
+// least-connections and power-of-two-choices
 type simpleServer struct {
-	address string
-	proxy *httputil.ReverseProxy
+	address  string
+	proxy    *httputil.ReverseProxy
+	liveness *liveness
+	weight   int64
+	inflight int64
+}
+
+// upstreamTransport is shared by every simpleServer's ReverseProxy so
+// backend connections are pooled across servers rather than per-proxy, and
+// so upstreams that speak HTTP/2 over TLS get negotiated up to it.
+var upstreamTransport = &http.Transport{
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   10,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// NewLoadBalancer returns a LoadBalancer that dispatches across a single
+// default pool of servers using balancer. A nil balancer defaults to round
+// robin. Use NewLoadBalancerWithRouter for host/path-based routing across
+// multiple pools.
+func NewLoadBalancer(port string, servers []Server, balancer Balancer) *LoadBalancer {
+	return NewLoadBalancerWithRouter(port, &Router{Default: NewPool("default", servers, balancer)})
 }
 
-// This is the ServeHTTP method
-// It takes in a request and response and does the following:
-func NewLoadBalancer(port string, servers []Server) *LoadBalancer {
-	return &LoadBalancer{
-		port: 				port,
-		roundRobinCounter: 	0,
-		servers: 			servers,
+// NewLoadBalancerWithRouter returns a LoadBalancer that dispatches each
+// request to a Pool chosen by router.
+func NewLoadBalancerWithRouter(port string, router *Router) *LoadBalancer {
+	lb := &LoadBalancer{
+		port:           port,
+		RequestTimeout: 10 * time.Second,
+		MaxRetries:     2,
 	}
+	lb.router.Store(router)
+	return lb
 }
 
-func (s *simpleServer) Address() string  { return s.address }
+// getRouter returns the LoadBalancer's current router snapshot.
+func (lb *LoadBalancer) getRouter() *Router {
+	return lb.router.Load()
+}
+
+func (s *simpleServer) Address() string { return s.address }
+
+func (s *simpleServer) IsAlive() bool { return s.liveness.IsAlive() }
+
+func (s *simpleServer) MarkDown() { s.liveness.MarkDown() }
+
+func (s *simpleServer) MarkUp() { s.liveness.MarkUp() }
+
+// Drain and Undrain satisfy Drainer, for use by the admin API's drain flag;
+// see liveness for why this is kept separate from MarkDown/MarkUp.
+func (s *simpleServer) Drain() { s.liveness.Drain() }
+
+func (s *simpleServer) Undrain() { s.liveness.Undrain() }
+
+// livenessState satisfies the unexported interface HealthChecker uses to
+// read and update a server's consecutive success/failure counters.
+func (s *simpleServer) livenessState() *liveness { return s.liveness }
+
+// Weight reports this server's relative share for weighted strategies.
+func (s *simpleServer) Weight() int { return int(atomic.LoadInt64(&s.weight)) }
 
-func (s *simpleServer) IsAlive() bool    { return true }
+// SetWeight changes this server's relative share for weighted strategies,
+// for use by the admin API.
+func (s *simpleServer) SetWeight(w int) { atomic.StoreInt64(&s.weight, int64(w)) }
+
+// Inflight reports the number of requests currently being served.
+func (s *simpleServer) Inflight() int64 { return atomic.LoadInt64(&s.inflight) }
 
 func (s *simpleServer) Serve(rw http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
 	s.proxy.ServeHTTP(rw, r)
 }
 
@@ -67,57 +163,325 @@ func handleErr(err error) {
 	}
 }
 
-// NewSimpleServer returns a new simpleServer
+// newSimpleServer returns a new simpleServer with weight 1
 // The address is the address of the server
 // The proxy is the proxy that the server uses to connect to the server
 func newSimpleServer(address string) *simpleServer {
+	return newWeightedSimpleServer(address, 1)
+}
+
+// newWeightedSimpleServer returns a new simpleServer with the given relative
+// weight, for use with the weighted balancing strategies.
+func newWeightedSimpleServer(address string, weight int) *simpleServer {
 	serverUrl, err := url.Parse(address)
 	handleErr(err)
 
+	proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+	proxy.Transport = upstreamTransport
+	// Connection-level failures (refused, timeout, DNS, ...) don't return
+	// from ServeHTTP as an error; ErrorHandler is the only hook that sees
+	// them, so report them back to serveProxy for retry purposes. Default
+	// to ReverseProxy's usual 502 rather than leaving the response open.
+	proxy.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
+		reportProxyErr(r.Context(), err)
+		rw.WriteHeader(http.StatusBadGateway)
+	}
+
 	return &simpleServer{
-		address: address,
-		proxy: httputil.NewSingleHostReverseProxy(serverUrl),
+		address:  address,
+		proxy:    proxy,
+		liveness: newLiveness(),
+		weight:   int64(weight),
+	}
+}
+
+// StartHealthChecks launches a HealthChecker using cfg over every pool
+// reachable from lb's router, keeping each one around so Stop can halt it
+// later.
+func (lb *LoadBalancer) StartHealthChecks(cfg HealthCheckConfig) {
+	for _, pool := range lb.getRouter().pools() {
+		pool.StartHealthChecks(cfg)
+	}
+}
+
+// Stop halts any background health checking started via StartHealthChecks,
+// across every pool reachable from lb's router.
+func (lb *LoadBalancer) Stop() {
+	for _, pool := range lb.getRouter().pools() {
+		pool.Stop()
+	}
+}
+
+// SetMetrics attaches m so every pool reachable from lb's router reports
+// its health-state gauges under it. Call before StartHealthChecks.
+func (lb *LoadBalancer) SetMetrics(m *Metrics) {
+	lb.metrics = m
+	for _, pool := range lb.getRouter().pools() {
+		pool.SetMetrics(m)
 	}
 }
 
-// getNextAvailableServer returns the address of the next available server to send a
-// request to, using a simple round robin algorithm
-func (lb *LoadBalancer) getNextAvailableServer() Server {
-	server := lb.servers[lb.roundRobinCounter%len(lb.servers)]
-	for !server.IsAlive() {
-		lb.roundRobinCounter++
-		server = lb.servers[lb.roundRobinCounter%len(lb.servers)]
+// ready reports whether every pool reachable from lb's router has at least
+// one healthy backend, for use by a /ready endpoint.
+func (lb *LoadBalancer) ready() bool {
+	for _, pool := range lb.getRouter().pools() {
+		if !pool.anyAlive() {
+			return false
+		}
 	}
-	lb.roundRobinCounter++
-	
-	return server
+	return true
 }
 
+// serveProxy resolves req to a pool, then tries servers in that pool one at
+// a time (up to lb.MaxRetries retries) until one returns a non-5xx response
+// or the request's budget (lb.RequestTimeout) runs out. Each attempt goes
+// through a retryRecorder, which buffers only until the status code is
+// known not to need a retry, so a failing attempt never reaches the real
+// client before a later attempt succeeds, but a streamed success isn't
+// held in memory or delayed.
 func (lb *LoadBalancer) serveProxy(rw http.ResponseWriter, req *http.Request) {
-	targetServer := lb.getNextAvailableServer()
+	lb.metrics.incActiveRequests()
+	defer lb.metrics.decActiveRequests()
+
+	requestID := newRequestID()
+	req.Header.Set("X-Request-Id", requestID)
+	rw.Header().Set("X-Request-Id", requestID)
+
+	ctx := req.Context()
+	if lb.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lb.RequestTimeout)
+		defer cancel()
+	}
+
+	lb.applyForwardedHeaders(req)
 
-	// could optionally log stuff the requests here!
-	fmt.Printf("forwarding request to '%s'\n", targetServer.Address())
+	pool := lb.getRouter().Resolve(req)
 
-	// could delete pre-existing X-Forwarded-For header to prevent IP spoofing
-	targetServer.Serve(rw, req)
+	if isUpgradeRequest(req) {
+		// ReverseProxy proxies upgrades (e.g. WebSocket) by hijacking the
+		// ResponseWriter's connection, which retryRecorder can't do; go
+		// straight to a single server with no buffering or retries.
+		targetServer, ok := pool.next(req)
+		if !ok {
+			http.Error(rw, "no backends available", http.StatusServiceUnavailable)
+			return
+		}
+		targetServer.Serve(rw, req.WithContext(ctx))
+		return
+	}
+
+	if err := bufferRequestBody(req); err != nil {
+		http.Error(rw, "reading request body", http.StatusBadRequest)
+		return
+	}
+
+	tried := make(map[Server]bool, lb.MaxRetries+1)
+	var rec *retryRecorder
+
+	for attempt := 0; attempt <= lb.MaxRetries; attempt++ {
+		targetServer, ok := pool.next(req)
+		if !ok {
+			if rec == nil {
+				http.Error(rw, "no backends available", http.StatusServiceUnavailable)
+				return
+			}
+			break
+		}
+		if tried[targetServer] {
+			// The balancer picked a server this request already tried (the
+			// pool is smaller than MaxRetries+1, or the strategy is sticky);
+			// stop rather than retry it.
+			break
+		}
+		tried[targetServer] = true
+
+		if attempt > 0 {
+			lb.metrics.observeRetry()
+		}
+
+		var upstreamErr error
+		attemptReq := req.WithContext(withProxyErrSlot(ctx, &upstreamErr))
+		if req.GetBody != nil {
+			// The previous attempt's ReverseProxy already drained req.Body;
+			// rewind it from the buffer bufferRequestBody stashed so a
+			// retried POST/PUT doesn't replay with an empty body.
+			body, err := req.GetBody()
+			if err != nil {
+				http.Error(rw, "rewinding request body", http.StatusInternalServerError)
+				return
+			}
+			attemptReq.Body = body
+		}
+
+		start := time.Now()
+		rec = newRetryRecorder(rw)
+		targetServer.Serve(rec, attemptReq)
+		elapsed := time.Since(start)
+
+		lb.metrics.observeRequest(targetServer.Address(), rec.statusCode, elapsed)
+		slog.Info("forwarded request",
+			"request_id", requestID,
+			"backend", targetServer.Address(),
+			"method", req.Method,
+			"path", req.URL.Path,
+			"attempt", attempt+1,
+			"status", rec.statusCode,
+			"latency", elapsed,
+		)
+
+		failed := upstreamErr != nil || rec.statusCode >= http.StatusInternalServerError
+		pool.RecordResult(targetServer, failed)
+
+		if rec.committed {
+			// Headers (and maybe part of a streamed body) already reached
+			// the real client, either because the status didn't need
+			// retrying or a connection failure happened partway through
+			// one; either way there's nothing left to retry against.
+			return
+		}
+
+		// Connection refused, timeout, or a 5xx: don't take the server out
+		// of rotation for everyone on one bad response (that's what the
+		// outlier detector above is for) - just don't pick it again for
+		// the rest of this request, via the tried set.
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if rec != nil {
+		rec.flush()
+	}
 }
 
 func main() {
-	servers := []Server{
-		newSimpleServer("https://www.google.com"),
-		newSimpleServer("https://www.bing.com"),
-		newSimpleServer("https://www.duckduckgo.com"),
+	configPath := flag.String("config", "", "path to a YAML or JSON config file (see config.go); when unset, a small hardcoded demo pool is used")
+	flag.Parse()
+
+	var lb *LoadBalancer
+	var adminToken string
+	adminAddr := ":9090"
+	var tlsConfig *tls.Config
+	var acmeHandler http.Handler
+	var redirectHTTP bool
+
+	if *configPath != "" {
+		cfg, err := LoadConfig(*configPath)
+		handleErr(err)
+
+		lb, err = BuildLoadBalancer(cfg)
+		handleErr(err)
+		adminToken = cfg.AdminToken
+		if cfg.AdminListen != "" {
+			adminAddr = cfg.AdminListen
+		}
+
+		if cfg.TLS != nil {
+			tlsConfig, acmeHandler, err = newTLSConfig(cfg.TLS.toTLSConfig())
+			handleErr(err)
+			redirectHTTP = cfg.TLS.RedirectHTTP
+		}
+	} else {
+		servers := []Server{
+			newSimpleServer("https://www.google.com"),
+			newSimpleServer("https://www.bing.com"),
+			newSimpleServer("https://www.duckduckgo.com"),
+		}
+		lb = NewLoadBalancer("8080", servers, nil)
+		lb.StartHealthChecks(DefaultHealthCheckConfig())
+	}
+
+	registry := prometheus.NewRegistry()
+	lb.SetMetrics(NewMetrics(registry))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", lb.serveProxy)
+
+	srv := &http.Server{
+		Addr:      ":" + lb.port,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
 	}
+	adminSrv := NewAdminServer(adminAddr, registry, lb, adminToken)
 
-	lb := NewLoadBalancer("8080", servers)
-	handleRedirect := func(rw http.ResponseWriter, req *http.Request) {
-		lb.serveProxy(rw, req)
+	var challengeSrv *http.Server
+	if acmeHandler != nil || redirectHTTP {
+		handler := acmeHandler
+		if redirectHTTP {
+			handler = httpRedirectHandler(lb.port)
+			if acmeHandler != nil {
+				// ACME's HTTP-01 challenge paths must still be served
+				// unredirected, or the CA can never validate us.
+				redirect := handler
+				mux := http.NewServeMux()
+				mux.Handle("/.well-known/acme-challenge/", acmeHandler)
+				mux.Handle("/", redirect)
+				handler = mux
+			}
+		}
+		challengeSrv = &http.Server{Addr: ":80", Handler: handler}
 	}
 
-	// Register a proxy handle all requests
-	http.HandleFunc("/", handleRedirect)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *configPath != "" {
+		go WatchConfig(ctx, *configPath, 5*time.Second, func(cfg *Config) {
+			if err := lb.ApplyConfig(cfg); err != nil {
+				slog.Error("applying reloaded config", "error", err)
+				return
+			}
+			slog.Info("reloaded config", "path", *configPath)
+		})
+	}
+
+	go func() {
+		slog.Info("serving requests", "addr", "localhost:"+lb.port, "tls", tlsConfig != nil)
+		var err error
+		if tlsConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("proxy listener stopped", "error", err)
+		}
+	}()
+
+	go func() {
+		slog.Info("serving admin endpoints", "addr", adminAddr)
+		if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("admin listener stopped", "error", err)
+		}
+	}()
 
-	fmt.Printf("serving requests at 'localhost:%s'\n", lb.port)
-	http.ListenAndServe(":"+lb.port, nil)
-}
\ No newline at end of file
+	if challengeSrv != nil {
+		go func() {
+			slog.Info("serving http challenge/redirect listener", "addr", "localhost:80")
+			if err := challengeSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("http listener stopped", "error", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down, draining in-flight requests...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("error shutting down proxy listener", "error", err)
+	}
+	if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("error shutting down admin listener", "error", err)
+	}
+	if challengeSrv != nil {
+		if err := challengeSrv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("error shutting down http listener", "error", err)
+		}
+	}
+	lb.Stop()
+}
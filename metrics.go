@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors the load balancer reports on.
+// Construct one with NewMetrics and attach it with LoadBalancer.SetMetrics; a nil
+// *Metrics on LoadBalancer disables instrumentation.
+type Metrics struct {
+	requestsTotal   *prometheus.CounterVec
+	upstreamLatency *prometheus.HistogramVec
+	retriesTotal    prometheus.Counter
+	activeRequests  prometheus.Gauge
+	backendUp       *prometheus.GaugeVec
+}
+
+// NewMetrics registers the load balancer's collectors against reg and
+// returns a Metrics to record against. Pass prometheus.NewRegistry() for an
+// isolated registry, or prometheus.DefaultRegisterer to use the global one.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
+
+	return &Metrics{
+		requestsTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "loadbalancer_requests_total",
+			Help: "Total requests handled, labeled by backend and response status.",
+		}, []string{"backend", "status"}),
+
+		upstreamLatency: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "loadbalancer_upstream_latency_seconds",
+			Help:    "Latency of upstream requests, labeled by backend.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"backend"}),
+
+		retriesTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "loadbalancer_retries_total",
+			Help: "Total number of retry attempts across all backends.",
+		}),
+
+		activeRequests: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "loadbalancer_active_requests",
+			Help: "Number of requests currently being proxied.",
+		}),
+
+		backendUp: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "loadbalancer_backend_up",
+			Help: "Health state of each backend (1 = up, 0 = down).",
+		}, []string{"backend"}),
+	}
+}
+
+func (m *Metrics) observeRequest(backend string, status int, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requestsTotal.WithLabelValues(backend, http.StatusText(status)).Inc()
+	m.upstreamLatency.WithLabelValues(backend).Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) observeRetry() {
+	if m == nil {
+		return
+	}
+	m.retriesTotal.Inc()
+}
+
+func (m *Metrics) incActiveRequests() {
+	if m == nil {
+		return
+	}
+	m.activeRequests.Inc()
+}
+
+func (m *Metrics) decActiveRequests() {
+	if m == nil {
+		return
+	}
+	m.activeRequests.Dec()
+}
+
+func (m *Metrics) setBackendUp(backend string, up bool) {
+	if m == nil {
+		return
+	}
+	if up {
+		m.backendUp.WithLabelValues(backend).Set(1)
+	} else {
+		m.backendUp.WithLabelValues(backend).Set(0)
+	}
+}
+
+// NewAdminServer returns an http.Server exposing Prometheus metrics at
+// /metrics, /healthz and /ready, and the /admin/servers backend-management
+// API (guarded by adminToken; see requireAdminToken). It's meant to listen
+// on a separate address from the proxy itself (":9090" by default) so the
+// admin surface stays reachable even if the proxy listener is saturated.
+func NewAdminServer(addr string, reg *prometheus.Registry, lb *LoadBalancer, adminToken string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/ready", func(rw http.ResponseWriter, r *http.Request) {
+		if !lb.ready() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			rw.Write([]byte("no healthy backends"))
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("ready"))
+	})
+
+	serversAPI := requireAdminToken(adminToken, adminServersHandler(lb))
+	mux.Handle("/admin/servers", serversAPI)
+	mux.Handle("/admin/servers/", serversAPI)
+
+	return &http.Server{Addr: addr, Handler: mux}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+)
+
+// proxyErrKey is the context key serveProxy uses to learn about connection
+// level failures (refused, timeout, DNS, ...) that a Server's ReverseProxy
+// hits while handling an attempt, so they can be retried against the next
+// server in the pool.
+type proxyErrKey struct{}
+
+// withProxyErrSlot attaches slot to ctx; a ReverseProxy's ErrorHandler
+// writes the error it sees into *slot.
+func withProxyErrSlot(ctx context.Context, slot *error) context.Context {
+	return context.WithValue(ctx, proxyErrKey{}, slot)
+}
+
+// reportProxyErr records err against the slot attached to ctx by
+// withProxyErrSlot, if any.
+func reportProxyErr(ctx context.Context, err error) {
+	if slot, ok := ctx.Value(proxyErrKey{}).(*error); ok {
+		*slot = err
+	}
+}
+
+// bufferRequestBody reads req.Body fully into memory and sets req.GetBody so
+// each retry attempt can rewind it to the start. A server's ReverseProxy
+// consumes req.Body as it forwards the request, so without this a retried
+// attempt would replay with an empty or partial body. No-op if req already
+// has no body or already knows how to replay one (e.g. GetBody is already
+// set).
+func bufferRequestBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return nil
+}
+
+// retryRecorder sits in front of the real http.ResponseWriter so serveProxy
+// can inspect an attempt's status code and decide whether to retry it
+// against another server before anything reaches the client. It only
+// buffers the response while that decision is still open: once WriteHeader
+// reports a status that won't be retried, it commits immediately (writing
+// the real header) and every subsequent Write streams straight through, so
+// a large or long-lived response (e.g. a download or an SSE stream) isn't
+// held in memory or delayed waiting for upstream to finish.
+type retryRecorder struct {
+	rw         http.ResponseWriter
+	header     http.Header
+	body       bytes.Buffer
+	statusCode int
+	committed  bool
+}
+
+func newRetryRecorder(rw http.ResponseWriter) *retryRecorder {
+	return &retryRecorder{rw: rw, header: make(http.Header), statusCode: http.StatusOK}
+}
+
+func (r *retryRecorder) Header() http.Header { return r.header }
+
+func (r *retryRecorder) Write(b []byte) (int, error) {
+	if r.committed {
+		return r.rw.Write(b)
+	}
+	return r.body.Write(b)
+}
+
+// WriteHeader records statusCode and, if it's not going to be retried,
+// commits: the real header and status line are written immediately and
+// later Writes pass straight through instead of buffering.
+func (r *retryRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	if statusCode < http.StatusInternalServerError {
+		r.commit()
+	}
+}
+
+func (r *retryRecorder) commit() {
+	if r.committed {
+		return
+	}
+	r.committed = true
+
+	header := r.rw.Header()
+	for key, values := range r.header {
+		for _, v := range values {
+			header.Add(key, v)
+		}
+	}
+	r.rw.WriteHeader(r.statusCode)
+}
+
+// flush copies a buffered (never-committed) response onto the real
+// http.ResponseWriter. Used once retries are exhausted and the last
+// attempt's failing response has to be shown to the client anyway.
+func (r *retryRecorder) flush() {
+	if r.committed {
+		return
+	}
+	r.commit()
+	r.rw.Write(r.body.Bytes())
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Pool is a named group of backend servers with its own balancing strategy
+// and health checker, so different routes can front entirely different
+// backend sets. Its server list is held as a copy-on-write snapshot behind
+// an atomic.Value: Servers() always returns a consistent slice even while
+// AddServer/RemoveServer are mutating it from the admin API.
+type Pool struct {
+	Name string
+
+	servers atomic.Value // []Server
+
+	mu             sync.Mutex // guards balancer-set mutation below
+	balancer       Balancer
+	healthChecker  *HealthChecker
+	healthCheckCfg *HealthCheckConfig
+	metrics        *Metrics
+}
+
+// NewPool returns a Pool dispatching across servers with balancer. A nil
+// balancer defaults to round robin.
+func NewPool(name string, servers []Server, balancer Balancer) *Pool {
+	if balancer == nil {
+		balancer = NewRoundRobinBalancer()
+	}
+
+	p := &Pool{
+		Name:     name,
+		balancer: balancer,
+	}
+	p.servers.Store(servers)
+	return p
+}
+
+// Servers returns a point-in-time snapshot of the pool's backend servers.
+// Safe to call concurrently with AddServer/RemoveServer.
+func (p *Pool) Servers() []Server {
+	v := p.servers.Load()
+	if v == nil {
+		return nil
+	}
+	return v.([]Server)
+}
+
+// AddServer appends s to the pool by swapping in a new server slice, and
+// restarts health checking (if running) so s is probed too.
+func (p *Pool) AddServer(s Server) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cur := p.Servers()
+	next := make([]Server, len(cur)+1)
+	copy(next, cur)
+	next[len(cur)] = s
+	p.servers.Store(next)
+
+	p.restartHealthChecksLocked()
+}
+
+// RemoveServer drops the server at addr from the pool, restarting health
+// checking (if running) so it stops being probed. Reports whether a server
+// was actually removed.
+func (p *Pool) RemoveServer(addr string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cur := p.Servers()
+	next := make([]Server, 0, len(cur))
+	removed := false
+	for _, s := range cur {
+		if s.Address() == addr {
+			removed = true
+			continue
+		}
+		next = append(next, s)
+	}
+	if !removed {
+		return false
+	}
+
+	p.servers.Store(next)
+	p.restartHealthChecksLocked()
+	return true
+}
+
+// FindServer returns the server at addr, or nil if the pool has none.
+func (p *Pool) FindServer(addr string) Server {
+	for _, s := range p.Servers() {
+		if s.Address() == addr {
+			return s
+		}
+	}
+	return nil
+}
+
+// StartHealthChecks launches a HealthChecker over the pool's servers using
+// cfg, remembering cfg so later AddServer/RemoveServer calls can restart
+// checking over the new server list.
+func (p *Pool) StartHealthChecks(cfg HealthCheckConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.healthCheckCfg = &cfg
+	p.restartHealthChecksLocked()
+}
+
+// restartHealthChecksLocked stops any running health checker and starts a
+// fresh one over the current server snapshot, using the last config passed
+// to StartHealthChecks. Callers must hold p.mu.
+func (p *Pool) restartHealthChecksLocked() {
+	if p.healthCheckCfg == nil {
+		return
+	}
+	if p.healthChecker != nil {
+		p.healthChecker.Stop()
+	}
+
+	p.healthChecker = NewHealthChecker(*p.healthCheckCfg, p.Servers())
+	p.healthChecker.SetMetrics(p.metrics)
+	p.healthChecker.Start()
+}
+
+// Stop halts the pool's health checker, if one was started.
+func (p *Pool) Stop() {
+	if p.healthChecker != nil {
+		p.healthChecker.Stop()
+	}
+}
+
+// SetMetrics attaches m so this pool's health-state gauges are reported
+// under it. Safe to call either before or after StartHealthChecks: if a
+// checker is already running, m is injected into it directly rather than
+// waiting for the next restart (e.g. from AddServer/RemoveServer).
+func (p *Pool) SetMetrics(m *Metrics) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.metrics = m
+	if p.healthChecker != nil {
+		p.healthChecker.SetMetrics(m)
+	}
+}
+
+// RecordResult feeds a live traffic outcome for s into the pool's health
+// checker (if one is running), for passive outlier detection. It's a no-op
+// if the pool has no health checker started.
+func (p *Pool) RecordResult(s Server, failed bool) {
+	p.mu.Lock()
+	hc := p.healthChecker
+	p.mu.Unlock()
+
+	if hc != nil {
+		hc.RecordResult(s, failed)
+	}
+}
+
+// anyAlive reports whether at least one server in the pool is currently up.
+func (p *Pool) anyAlive() bool {
+	for _, s := range p.Servers() {
+		if s.IsAlive() {
+			return true
+		}
+	}
+	return false
+}
+
+// next filters the pool down to currently alive servers (falling back to
+// the full pool if every server is down) and asks the balancer to pick
+// among them. Reports false if the pool has no servers at all (e.g. the
+// last backend was just removed via the admin API, or it was declared
+// empty in config), in which case callers must not call the balancer.
+func (p *Pool) next(req *http.Request) (Server, bool) {
+	servers := p.Servers()
+	if len(servers) == 0 {
+		return nil, false
+	}
+
+	alive := make([]Server, 0, len(servers))
+	for _, s := range servers {
+		if s.IsAlive() {
+			alive = append(alive, s)
+		}
+	}
+	if len(alive) == 0 {
+		alive = servers
+	}
+
+	return p.balancer.Next(alive, req), true
+}
+
+// Route matches incoming requests against Host/path/method/header
+// predicates and dispatches matches to Pool. A zero-value matcher field
+// always matches, so e.g. a Route with only Host set matches any path or
+// method on that host.
+type Route struct {
+	// Host, if set, must equal the request's Host header exactly.
+	Host string
+
+	// PathPrefix, if set, must prefix the request path.
+	PathPrefix string
+
+	// PathRegex, if set, must match the request path.
+	PathRegex *regexp.Regexp
+
+	// Method, if set, must equal the request method (case-insensitive).
+	Method string
+
+	// Headers, if set, must all be present on the request with matching
+	// values.
+	Headers map[string]string
+
+	// Pool is the backend pool requests matching this route are sent to.
+	Pool *Pool
+}
+
+// Matches reports whether req satisfies every predicate set on the route.
+func (rt *Route) Matches(req *http.Request) bool {
+	if rt.Host != "" && req.Host != rt.Host {
+		return false
+	}
+	if rt.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	if rt.PathRegex != nil && !rt.PathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+	if rt.Method != "" && !strings.EqualFold(rt.Method, req.Method) {
+		return false
+	}
+	for header, want := range rt.Headers {
+		if req.Header.Get(header) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// Router resolves an incoming request to a Pool by checking Routes in
+// order and falling back to Default when none match.
+type Router struct {
+	Routes  []*Route
+	Default *Pool
+}
+
+// Resolve returns the Pool that should serve req.
+func (rt *Router) Resolve(req *http.Request) *Pool {
+	for _, route := range rt.Routes {
+		if route.Matches(req) {
+			return route.Pool
+		}
+	}
+	return rt.Default
+}
+
+// pools returns every distinct Pool reachable from the router (the default
+// pool plus each route's pool), in case several routes share one.
+func (rt *Router) pools() []*Pool {
+	seen := make(map[*Pool]bool)
+	var pools []*Pool
+
+	add := func(p *Pool) {
+		if p != nil && !seen[p] {
+			seen[p] = true
+			pools = append(pools, p)
+		}
+	}
+
+	add(rt.Default)
+	for _, route := range rt.Routes {
+		add(route.Pool)
+	}
+	return pools
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig describes how the proxy listener should terminate TLS: either a
+// static certificate/key pair, or automatic certificates from an ACME CA
+// (e.g. Let's Encrypt) for a fixed set of hostnames.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+
+	ACMEEnabled  bool
+	ACMEHosts    []string
+	ACMECacheDir string
+
+	// RedirectHTTP, if true, has main start a plain HTTP listener on :80
+	// that redirects every request to its https:// equivalent. ACME mode
+	// also needs this listener to serve HTTP-01 challenge responses, so
+	// its handler is returned regardless of RedirectHTTP when ACME is on.
+	RedirectHTTP bool
+}
+
+// newTLSConfig builds a *tls.Config for the proxy's listener from cfg. When
+// ACME is enabled it returns an autocert manager's config along with its
+// HTTP-01 challenge handler (for main to mount on a :80 listener); the
+// handler is nil for static cert/key mode.
+func newTLSConfig(cfg TLSConfig) (*tls.Config, http.Handler, error) {
+	if cfg.ACMEEnabled {
+		if len(cfg.ACMEHosts) == 0 {
+			return nil, nil, fmt.Errorf("tls: acmeEnabled requires at least one acmeHosts entry")
+		}
+
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEHosts...),
+			Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		}
+		return manager.TLSConfig(), manager.HTTPHandler(nil), nil
+	}
+
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, nil, fmt.Errorf("tls: certFile and keyFile are required unless acmeEnabled is set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading tls key pair: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil, nil
+}
+
+// httpRedirectHandler responds to every request by redirecting to the same
+// URL over https, on targetPort (the proxy's TLS listener port).
+func httpRedirectHandler(targetPort string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if targetPort != "" && targetPort != "443" {
+			host = host + ":" + targetPort
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(rw, r, target, http.StatusMovedPermanently)
+	})
+}